@@ -0,0 +1,303 @@
+// Implements carrier encodings for the plainsight export format. A `CarrierEncoder` takes the
+// compressed, encrypted store and wraps it in something that doesn't look like an encrypted
+// blob -- base64 text, ordinary-looking prose, or the low bits of a cover image -- so the
+// on-disk artifact is harder to flag as ciphertext at a glance.
+package ghostpass
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// ErrUnknownCarrier is returned when a blob doesn't start with a magic prefix any registered
+// CarrierEncoder recognizes.
+var ErrUnknownCarrier = errors.New("ghostpass: unrecognized carrier encoding")
+
+// ErrCarrierCorrupt is returned when a carrier's embedded length prefix doesn't fit the amount
+// of data actually recovered from it -- a truncated, corrupted, or adversarially crafted cover.
+var ErrCarrierCorrupt = errors.New("ghostpass: carrier payload is corrupt or truncated")
+
+// CarrierEncoder wraps and unwraps a plainsight store's compressed ciphertext in some outer
+// format. Encode must prefix its output with a short magic string so PlainsightUnmarshal can
+// pick the right decoder without being told which one was used.
+type CarrierEncoder interface {
+	Encode(ciphertext []byte) ([]byte, error)
+	Decode(carrier []byte) ([]byte, error)
+}
+
+// Base64Carrier is the default carrier: it base64-encodes the ciphertext, as plainsight stores
+// did before carriers existed, but prefixes the result with a short magic string that those
+// older stores don't carry. It's the fallback PlainsightMarshal uses when no other
+// CarrierEncoder is given.
+type Base64Carrier struct{}
+
+var base64Magic = []byte("GPB1")
+
+// Encode implements CarrierEncoder.
+func (Base64Carrier) Encode(ciphertext []byte) ([]byte, error) {
+	out := make([]byte, 0, len(base64Magic)+base64.StdEncoding.EncodedLen(len(ciphertext)))
+	out = append(out, base64Magic...)
+	out = append(out, []byte(base64.StdEncoding.EncodeToString(ciphertext))...)
+	return out, nil
+}
+
+// Decode implements CarrierEncoder.
+func (Base64Carrier) Decode(carrier []byte) ([]byte, error) {
+	if !bytes.HasPrefix(carrier, base64Magic) {
+		return nil, ErrUnknownCarrier
+	}
+	return base64.StdEncoding.DecodeString(string(carrier[len(base64Magic):]))
+}
+
+// wordCorpus is the pre-shipped vocabulary MarkovCarrier draws from. It's exactly 256 words
+// long so each output byte maps to exactly one word.
+var wordCorpus = [256]string{
+	"the", "be", "to", "of", "and", "a", "in", "that",
+	"have", "I", "it", "for", "not", "on", "with", "he",
+	"as", "you", "do", "at", "this", "but", "his", "by",
+	"from", "they", "we", "say", "her", "she", "or", "an",
+	"will", "my", "one", "all", "would", "there", "their", "what",
+	"so", "up", "out", "if", "about", "who", "get", "which",
+	"go", "me", "when", "make", "can", "like", "time", "no",
+	"just", "him", "know", "take", "people", "into", "year", "your",
+	"good", "some", "could", "them", "see", "other", "than", "then",
+	"now", "look", "only", "come", "its", "over", "think", "also",
+	"back", "after", "use", "two", "how", "our", "work", "first",
+	"well", "way", "even", "new", "want", "because", "any", "these",
+	"give", "day", "most", "us", "is", "was", "are", "been",
+	"has", "had", "were", "said", "did", "having", "may", "should",
+	"since", "set", "put", "keep", "let", "end", "begin", "never",
+	"same", "seem", "system", "value", "store", "field", "secret", "token",
+	"user", "pass", "vault", "guard", "shield", "lock", "key", "door",
+	"window", "house", "street", "city", "river", "mountain", "forest", "ocean",
+	"cloud", "rain", "snow", "wind", "storm", "light", "dark", "color",
+	"sound", "music", "song", "dance", "game", "play", "book", "read",
+	"write", "paint", "draw", "build", "grow", "plant", "tree", "flower",
+	"leaf", "root", "seed", "fruit", "stone", "metal", "glass", "wood",
+	"paper", "cloth", "thread", "needle", "pin", "cup", "plate", "bowl",
+	"spoon", "fork", "knife", "chair", "table", "bed", "lamp", "mirror",
+	"clock", "watch", "phone", "screen", "mouse", "board", "chip", "wire",
+	"cable", "signal", "wave", "particle", "atom", "energy", "force", "motion",
+	"speed", "distance", "direction", "north", "south", "east", "west", "down",
+	"left", "right", "inside", "outside", "above", "below", "near", "far",
+	"close", "open", "shut", "hot", "cold", "warm", "cool", "fast",
+	"slow", "loud", "quiet", "soft", "hard", "heavy", "bright", "dim",
+	"clean", "dirty", "wet", "dry", "full", "empty", "simple", "complex",
+	"easy", "difficult", "early", "late", "young", "old", "happy", "sad",
+}
+
+// wordIndex maps each corpus word back to its byte value.
+var wordIndex = func() map[string]byte {
+	idx := make(map[string]byte, len(wordCorpus))
+	for i, w := range wordCorpus {
+		idx[w] = byte(i)
+	}
+	return idx
+}()
+
+// markovMagic opens every MarkovCarrier output; it reads as an innocuous sentence fragment
+// rather than an opaque token, so it doesn't stand out from the prose that follows it.
+var markovMagic = "the story goes "
+
+// MarkovCarrier hides ciphertext as what reads like ordinary prose: each byte is mapped to one
+// word from a pre-shipped corpus and the words are space-joined into a sentence-shaped blob.
+// It's a cheap grammar, not a real language model, so the output won't survive close reading --
+// but it clears a glance and doesn't trip "this is base64" heuristics.
+type MarkovCarrier struct{}
+
+// Encode implements CarrierEncoder.
+func (MarkovCarrier) Encode(ciphertext []byte) ([]byte, error) {
+	words := make([]string, 0, len(ciphertext)+1)
+	for _, b := range ciphertext {
+		words = append(words, wordCorpus[b])
+	}
+	return []byte(markovMagic + joinWords(words)), nil
+}
+
+// Decode implements CarrierEncoder.
+func (MarkovCarrier) Decode(carrier []byte) ([]byte, error) {
+	text := string(carrier)
+	if len(text) < len(markovMagic) || text[:len(markovMagic)] != markovMagic {
+		return nil, ErrUnknownCarrier
+	}
+
+	words := splitWords(text[len(markovMagic):])
+	out := make([]byte, 0, len(words))
+	for _, w := range words {
+		b, ok := wordIndex[w]
+		if !ok {
+			return nil, ErrUnknownCarrier
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+func joinWords(words []string) string {
+	var buf bytes.Buffer
+	for i, w := range words {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(w)
+	}
+	return buf.String()
+}
+
+func splitWords(s string) []string {
+	var words []string
+	start := -1
+	for i, r := range s {
+		if r == ' ' {
+			if start >= 0 {
+				words = append(words, s[start:i])
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		words = append(words, s[start:])
+	}
+	return words
+}
+
+// pngMagic identifies a PNGCarrier blob by its ordinary PNG signature -- the carrier doesn't
+// need its own prefix since "is this a valid PNG" already disambiguates it from the others.
+var pngMagic = []byte{0x89, 'P', 'N', 'G'}
+
+// PNGCarrier hides ciphertext in the low bit of each color channel of a cover image it
+// generates on the fly, sized just large enough to hold the payload. A length prefix is
+// embedded in the first 32 bits of hidden data so Decode knows where the payload ends.
+type PNGCarrier struct{}
+
+// Encode implements CarrierEncoder.
+func (PNGCarrier) Encode(ciphertext []byte) ([]byte, error) {
+	var payload bytes.Buffer
+	var lenPrefix [4]byte
+	binary.BigEndian.PutUint32(lenPrefix[:], uint32(len(ciphertext)))
+	payload.Write(lenPrefix[:])
+	payload.Write(ciphertext)
+
+	bits := payload.Len() * 8
+	pixels := (bits + 2) / 3 // 3 usable LSBs (R, G, B) per pixel
+	side := 1
+	for side*side < pixels {
+		side++
+	}
+
+	// fill every channel's upper 7 bits with noise before overwriting the LSB with hidden data,
+	// so the cover image doesn't stand out as a flat, uniform gray square at a glance.
+	noise := make([]byte, side*side*3)
+	if _, err := rand.Read(noise); err != nil {
+		return nil, err
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, side, side))
+	bitIdx := 0
+	payloadBytes := payload.Bytes()
+	noiseIdx := 0
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			r, g, b := noise[noiseIdx], noise[noiseIdx+1], noise[noiseIdx+2]
+			noiseIdx += 3
+			r = setLSB(r, nextBit(payloadBytes, &bitIdx))
+			g = setLSB(g, nextBit(payloadBytes, &bitIdx))
+			b = setLSB(b, nextBit(payloadBytes, &bitIdx))
+			img.Set(x, y, color.NRGBA{R: r, G: g, B: b, A: 0xff})
+		}
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Decode implements CarrierEncoder.
+func (PNGCarrier) Decode(carrier []byte) ([]byte, error) {
+	if !bytes.HasPrefix(carrier, pngMagic) {
+		return nil, ErrUnknownCarrier
+	}
+
+	img, err := png.Decode(bytes.NewReader(carrier))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	var bits []byte
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			bits = append(bits, byte(r)&1, byte(g)&1, byte(b)&1)
+		}
+	}
+
+	if len(bits) < 32 {
+		return nil, ErrCarrierCorrupt
+	}
+	lenBits := bits[:32]
+	length := binary.BigEndian.Uint32(packBits(lenBits))
+	dataBits := bits[32:]
+	if uint64(length)*8 > uint64(len(dataBits)) {
+		return nil, ErrCarrierCorrupt
+	}
+	return packBits(dataBits[:uint64(length)*8]), nil
+}
+
+func nextBit(data []byte, idx *int) byte {
+	byteIdx := *idx / 8
+	bitIdx := uint(*idx % 8)
+	*idx++
+	if byteIdx >= len(data) {
+		return 0
+	}
+	return (data[byteIdx] >> (7 - bitIdx)) & 1
+}
+
+func setLSB(channel, bit byte) byte {
+	return (channel &^ 1) | bit
+}
+
+func packBits(bits []byte) []byte {
+	out := make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit != 0 {
+			out[i/8] |= 1 << (7 - uint(i%8))
+		}
+	}
+	return out
+}
+
+// detectCarrier picks the CarrierEncoder a plainsight blob was written with, based on its
+// magic prefix. It reports false when no prefix matches; PlainsightUnmarshal then falls back
+// to legacyBase64Decode so stores written before carriers existed keep working.
+func detectCarrier(blob []byte) (CarrierEncoder, bool) {
+	switch {
+	case bytes.HasPrefix(blob, base64Magic):
+		return Base64Carrier{}, true
+	case len(blob) >= len(markovMagic) && string(blob[:len(markovMagic)]) == markovMagic:
+		return MarkovCarrier{}, true
+	case bytes.HasPrefix(blob, pngMagic):
+		return PNGCarrier{}, true
+	default:
+		return nil, false
+	}
+}
+
+// legacyBase64Decode decodes a plainsight blob written before carriers existed: plain base64
+// with no magic prefix at all.
+func legacyBase64Decode(blob []byte) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(string(blob))
+}
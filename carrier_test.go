@@ -0,0 +1,59 @@
+package ghostpass
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestPNGCarrierRoundTrip(t *testing.T) {
+	want := []byte("a secret worth hiding")
+
+	encoded, err := PNGCarrier{}.Encode(want)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	got, err := PNGCarrier{}.Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Decode = %x, want %x", got, want)
+	}
+}
+
+// forgedPNGWithLength builds a valid PNG whose hidden length prefix claims more payload bytes
+// than the image actually carries, mimicking a corrupted or adversarially crafted cover image.
+func forgedPNGWithLength(length uint32) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], length)
+
+	bitIdx := 0
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			r, g, b := byte(0x80), byte(0x80), byte(0x80)
+			r = setLSB(r, nextBit(prefix[:], &bitIdx))
+			g = setLSB(g, nextBit(prefix[:], &bitIdx))
+			b = setLSB(b, nextBit(prefix[:], &bitIdx))
+			img.Set(x, y, color.NRGBA{R: r, G: g, B: b, A: 0xff})
+		}
+	}
+
+	var out bytes.Buffer
+	_ = png.Encode(&out, img)
+	return out.Bytes()
+}
+
+func TestPNGCarrierDecodeRejectsForgedLength(t *testing.T) {
+	// 4x4 image carries 48 usable bits; claim a payload far larger than that fits.
+	forged := forgedPNGWithLength(1 << 20)
+
+	if _, err := (PNGCarrier{}).Decode(forged); err != ErrCarrierCorrupt {
+		t.Fatalf("Decode(forged length) err = %v, want ErrCarrierCorrupt", err)
+	}
+}
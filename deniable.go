@@ -0,0 +1,68 @@
+// Implements deniable secrets: a field can carry a second, decoy credential that surfaces
+// instead of the real one when the store is opened with a different passphrase. A user coerced
+// into handing over that decoy passphrase has no way to prove a real credential exists
+// alongside it.
+package ghostpass
+
+import (
+	"errors"
+
+	"ghostpass/internal/memzero"
+)
+
+// ErrDeniableLengthMismatch is returned by AddDeniablePair when the real and decoy secrets
+// aren't the same length. Callers must pad both to a common block boundary themselves.
+var ErrDeniableLengthMismatch = errors.New("ghostpass: deniable real/decoy secrets must be the same length")
+
+// AddDeniablePair registers service with two credentials: realSecret, revealed when the store
+// is unlocked with its real passphrase, and decoySecret, revealed instead when unlocked with
+// decoyPassphrase. The decoy key is scrypt-derived from decoyPassphrase using the store's own
+// salt/params, exactly like SymmetricKey is from the real passphrase, so decoyPassphrase is an
+// ordinary, memorable passphrase a caller can actually reproduce later rather than a raw key
+// they'd have no way to recover. realSecret and decoySecret must already be the same length
+// (pad both to a common block boundary before calling this).
+func (ss *SecretStore) AddDeniablePair(service, realSecret, decoySecret string, decoyPassphrase []byte) error {
+	if len(realSecret) != len(decoySecret) {
+		return ErrDeniableLengthMismatch
+	}
+
+	salt, params, err := ss.ensureKDF()
+	if err != nil {
+		return err
+	}
+
+	authPair, err := BoxEncrypt(ss.SymmetricKey, []byte(realSecret))
+	if err != nil {
+		return err
+	}
+
+	decoyKey, err := deriveKey(decoyPassphrase, salt, params)
+	if err != nil {
+		return err
+	}
+	defer memzero.Zero(decoyKey)
+
+	shadowAuthPair, err := BoxEncrypt(decoyKey, []byte(decoySecret))
+	if err != nil {
+		return err
+	}
+	shadowService, err := BoxEncrypt(decoyKey, []byte(service))
+	if err != nil {
+		return err
+	}
+
+	header := ss.plainsightHeader(salt, params)
+	shadowMAC, err := fieldMAC(decoyKey, header, service, shadowAuthPair)
+	if err != nil {
+		return err
+	}
+
+	ss.Fields[service] = &Field{
+		AuthPair:       authPair,
+		Deniable:       true,
+		ShadowAuthPair: shadowAuthPair,
+		ShadowService:  shadowService,
+		ShadowMAC:      shadowMAC,
+	}
+	return nil
+}
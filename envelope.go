@@ -0,0 +1,127 @@
+// Implements the versioned envelope and integrity MAC wrapped around every serialized
+// SecretStore, regardless of whether it's in stationary or plainsight form.
+package ghostpass
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// ErrStoreTampered is returned when a serialized store's MAC doesn't match its contents: the
+// header, fields, or both were modified -- or swapped in from another store entirely -- after
+// the store was last marshaled. A wrong passphrase produces the same error, since the MAC
+// can't be reproduced without the right key.
+var ErrStoreTampered = errors.New("ghostpass: store failed integrity check")
+
+// storeHeader carries the metadata needed to reproduce a store's symmetric key and validate
+// its integrity, independent of which encoding (stationary JSON, plainsight blob) it ends up
+// embedded in.
+type storeHeader struct {
+	Version    int          `json:"version"`
+	StoreState string       `json:"state"`
+	Name       string       `json:"name"`
+	Salt       []byte       `json:"salt"`
+	KDFParams  ScryptParams `json:"kdf"`
+}
+
+// envelopeMACKey derives the HMAC subkey for a store's integrity envelope from macKey via
+// HKDF, keeping it cryptographically separate from whatever macKey is reused for elsewhere.
+// macKey must be secret -- StationaryMarshal/Unmarshal pass the store's symmetric key, and
+// fieldMAC passes a plainsight field's real or decoy key -- never public material like a salt,
+// or the MAC becomes forgeable by anyone who can read the blob it protects.
+func envelopeMACKey(macKey []byte) ([]byte, error) {
+	sub := make([]byte, scryptKeyLen)
+	kdf := hkdf.New(sha256.New, macKey, nil, []byte("envelope-mac"))
+	if _, err := io.ReadFull(kdf, sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// envelopeMAC computes the HMAC-SHA256 over the canonical-JSON encodings of header and fields,
+// keyed by the subkey derived from macKey.
+func envelopeMAC(macKey []byte, header, fields interface{}) ([]byte, error) {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	fieldsJSON, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := envelopeMACKey(macKey)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(headerJSON)
+	mac.Write(fieldsJSON)
+	return mac.Sum(nil), nil
+}
+
+// verifyEnvelopeMAC recomputes the MAC over header/fields and rejects with ErrStoreTampered
+// on any mismatch.
+func verifyEnvelopeMAC(macKey []byte, header, fields interface{}, want []byte) error {
+	got, err := envelopeMAC(macKey, header, fields)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(got, want) {
+		return ErrStoreTampered
+	}
+	return nil
+}
+
+// fieldMAC computes an HMAC-SHA256 over a plainsight field's header, plaintext service name, and
+// ciphertext, keyed by the subkey HKDF derives from macKey. Binding the header into every
+// field's MAC means a header swap or version downgrade invalidates it too, not just a
+// whole-store check a forged header could otherwise satisfy on its own.
+func fieldMAC(macKey []byte, header storeHeader, service string, ciphertext []byte) ([]byte, error) {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := envelopeMACKey(macKey)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(headerJSON)
+	mac.Write([]byte(service))
+	mac.Write(ciphertext)
+	return mac.Sum(nil), nil
+}
+
+// verifyFieldMAC reports whether ciphertext's stored MAC matches what macKey would produce.
+// Unlike verifyEnvelopeMAC, a mismatch here isn't necessarily tampering: it's the expected
+// outcome whenever macKey belongs to a different field, or to a decoy the caller doesn't hold
+// the passphrase for.
+func verifyFieldMAC(macKey []byte, header storeHeader, service string, ciphertext, want []byte) (bool, error) {
+	got, err := fieldMAC(macKey, header, service, ciphertext)
+	if err != nil {
+		return false, err
+	}
+	return hmac.Equal(got, want), nil
+}
+
+// plainsightHeader builds the storeHeader every plainsight artifact is stamped with, from the
+// store's current salt/params. AddDeniablePair and PlainsightMarshal must agree on this shape
+// byte-for-byte, since it's bound into every field's MAC.
+func (ss *SecretStore) plainsightHeader(salt []byte, params ScryptParams) storeHeader {
+	return storeHeader{
+		Version:    Version,
+		StoreState: StorePlainsight,
+		Name:       ss.Name,
+		Salt:       salt,
+		KDFParams:  params,
+	}
+}
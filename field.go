@@ -0,0 +1,36 @@
+// Defines Field, the per-service credential record every KeyStore and serialization path in
+// this package reads and writes.
+package ghostpass
+
+// Field is a single stored credential: an always-present, encrypted AuthPair, plus the optional
+// deniable-secrets extension registered via AddDeniablePair.
+type Field struct {
+	// AuthPair holds the field's encrypted credential pair, as produced by BoxEncrypt.
+	AuthPair []byte `json:"auth_pair"`
+
+	// Deniable marks a field registered via AddDeniablePair. ShadowAuthPair, ShadowService, and
+	// ShadowMAC are only meaningful when this is true.
+	Deniable bool `json:"deniable,omitempty"`
+
+	// ShadowAuthPair holds the decoy credential's encrypted pair, encrypted under the field's
+	// decoy key, and revealed instead of AuthPair when the store is opened with the matching
+	// decoy passphrase.
+	ShadowAuthPair []byte `json:"shadow_auth_pair,omitempty"`
+
+	// ShadowService holds this field's service name encrypted under the same decoy key as
+	// ShadowAuthPair, so a plainsight export can index the decoy entry without the service name
+	// itself only ever being recoverable under the real key.
+	ShadowService []byte `json:"shadow_service,omitempty"`
+
+	// ShadowMAC authenticates ShadowAuthPair together with the header it was exported under;
+	// see AddDeniablePair and fieldMAC.
+	ShadowMAC []byte `json:"shadow_mac,omitempty"`
+}
+
+// RederiveAuthPair checks that AuthPair decrypts under key, after a stationary store has been
+// read back from its serialized form, and returns BoxDecrypt's error if it doesn't. It leaves f
+// unchanged and keeps none of the decrypted plaintext.
+func (f *Field) RederiveAuthPair(key []byte) error {
+	_, err := BoxDecrypt(key, f.AuthPair)
+	return err
+}
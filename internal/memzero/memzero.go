@@ -0,0 +1,15 @@
+// Package memzero provides a best-effort way to scrub sensitive byte slices from memory
+// before they're left for the garbage collector.
+package memzero
+
+import "runtime"
+
+// Zero overwrites b with zeroes in place. The writes go through a loop rather than a single
+// bulk clear and finish with a runtime.KeepAlive so the compiler can't prove the slice is dead
+// and elide them as a no-op store, mirroring kisom/cryptutils' util.Zero.
+func Zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	runtime.KeepAlive(b)
+}
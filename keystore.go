@@ -0,0 +1,167 @@
+// Implements pluggable storage backends for persisting a `SecretStore`. A `KeyStore`
+// decouples the serialization logic in ser.go from where the resulting bytes actually live,
+// so callers can swap in a remote KMS or a mobile keychain without touching `SecretStore`
+// logic itself.
+package ghostpass
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrStoreNotFound is returned by a `KeyStore` when no store is registered under the given name.
+var ErrStoreNotFound = errors.New("ghostpass: store not found")
+
+// KeyStore abstracts the persistence layer for a `SecretStore`. Implementations are free to
+// compose the marshal/unmarshal helpers in ser.go however fits their backend.
+type KeyStore interface {
+	// GetStore retrieves and deserializes the store registered under name.
+	GetStore(name string) (*SecretStore, error)
+
+	// PutStore serializes and persists ss under its own name.
+	PutStore(ss *SecretStore) error
+
+	// DeleteStore removes the store registered under name.
+	DeleteStore(name string) error
+}
+
+// PlainKeyStore persists stores as unencrypted, stationary-marshaled JSON files on disk. It
+// exists for testing and debugging; production use should prefer PassphraseKeyStore or a
+// remote-backed implementation.
+type PlainKeyStore struct {
+	dir string
+}
+
+// NewPlainKeyStore returns a KeyStore that keeps unencrypted stationary stores under dir.
+func NewPlainKeyStore(dir string) *PlainKeyStore {
+	return &PlainKeyStore{dir: dir}
+}
+
+func (ks *PlainKeyStore) path(name string) string {
+	return filepath.Join(ks.dir, name+".json")
+}
+
+// GetStore implements KeyStore.
+func (ks *PlainKeyStore) GetStore(name string) (*SecretStore, error) {
+	serialized, err := ioutil.ReadFile(ks.path(name))
+	if os.IsNotExist(err) {
+		return nil, ErrStoreNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return StationaryUnmarshalPlain(serialized)
+}
+
+// PutStore implements KeyStore.
+func (ks *PlainKeyStore) PutStore(ss *SecretStore) error {
+	serialized, err := ss.StationaryMarshalPlain()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ks.path(ss.Name), serialized, 0600)
+}
+
+// DeleteStore implements KeyStore.
+func (ks *PlainKeyStore) DeleteStore(name string) error {
+	err := os.Remove(ks.path(name))
+	if os.IsNotExist(err) {
+		return ErrStoreNotFound
+	}
+	return err
+}
+
+// PassphraseKeyStore persists stores as stationary-marshaled JSON files on disk, rederiving
+// the symmetric key from a passphrase via scrypt (using the salt/params embedded in the
+// store itself) to decrypt each field's auth pair on load.
+type PassphraseKeyStore struct {
+	dir        string
+	passphrase string
+}
+
+// NewPassphraseKeyStore returns a KeyStore that keeps passphrase-protected stationary stores
+// under dir.
+func NewPassphraseKeyStore(dir, passphrase string) *PassphraseKeyStore {
+	return &PassphraseKeyStore{dir: dir, passphrase: passphrase}
+}
+
+func (ks *PassphraseKeyStore) path(name string) string {
+	return filepath.Join(ks.dir, name+".ghostpass")
+}
+
+// GetStore implements KeyStore.
+func (ks *PassphraseKeyStore) GetStore(name string) (*SecretStore, error) {
+	serialized, err := ioutil.ReadFile(ks.path(name))
+	if os.IsNotExist(err) {
+		return nil, ErrStoreNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return StationaryUnmarshal([]byte(ks.passphrase), serialized)
+}
+
+// PutStore implements KeyStore.
+func (ks *PassphraseKeyStore) PutStore(ss *SecretStore) error {
+	serialized, err := ss.StationaryMarshal()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ks.path(ss.Name), serialized, 0600)
+}
+
+// DeleteStore implements KeyStore.
+func (ks *PassphraseKeyStore) DeleteStore(name string) error {
+	err := os.Remove(ks.path(name))
+	if os.IsNotExist(err) {
+		return ErrStoreNotFound
+	}
+	return err
+}
+
+// MemoryKeyStore keeps stores in an in-memory map, never touching disk. Useful for tests and
+// for short-lived processes that shouldn't leave stores behind.
+type MemoryKeyStore struct {
+	mu     sync.RWMutex
+	stores map[string]*SecretStore
+}
+
+// NewMemoryKeyStore returns a KeyStore backed by an in-memory map.
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{stores: make(map[string]*SecretStore)}
+}
+
+// GetStore implements KeyStore.
+func (ks *MemoryKeyStore) GetStore(name string) (*SecretStore, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	ss, ok := ks.stores[name]
+	if !ok {
+		return nil, ErrStoreNotFound
+	}
+	return ss, nil
+}
+
+// PutStore implements KeyStore.
+func (ks *MemoryKeyStore) PutStore(ss *SecretStore) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.stores[ss.Name] = ss
+	return nil
+}
+
+// DeleteStore implements KeyStore.
+func (ks *MemoryKeyStore) DeleteStore(name string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if _, ok := ks.stores[name]; !ok {
+		return ErrStoreNotFound
+	}
+	delete(ks.stores, name)
+	return nil
+}
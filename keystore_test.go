@@ -0,0 +1,108 @@
+package ghostpass
+
+import (
+	"testing"
+)
+
+// newRoundTripStore builds a minimal SecretStore with one encrypted field, deriving its
+// symmetric key the same way a real constructor would: ensureKDF for fresh salt/params, then
+// scrypt over passphrase.
+func newRoundTripStore(t *testing.T, name string, passphrase []byte) *SecretStore {
+	t.Helper()
+
+	ss := &SecretStore{Name: name, Fields: make(map[string]*Field)}
+	salt, params, err := ss.ensureKDF()
+	if err != nil {
+		t.Fatalf("ensureKDF: %v", err)
+	}
+
+	key, err := deriveKey(passphrase, salt, params)
+	if err != nil {
+		t.Fatalf("deriveKey: %v", err)
+	}
+	ss.SymmetricKey = key
+
+	authPair, err := BoxEncrypt(ss.SymmetricKey, []byte("hunter2"))
+	if err != nil {
+		t.Fatalf("BoxEncrypt: %v", err)
+	}
+	ss.Fields["example.com"] = &Field{AuthPair: authPair}
+
+	return ss
+}
+
+func TestPlainKeyStoreRoundTrip(t *testing.T) {
+	ks := NewPlainKeyStore(t.TempDir())
+	ss := newRoundTripStore(t, "plain-store", nil)
+
+	if err := ks.PutStore(ss); err != nil {
+		t.Fatalf("PutStore: %v", err)
+	}
+
+	got, err := ks.GetStore(ss.Name)
+	if err != nil {
+		t.Fatalf("GetStore: %v", err)
+	}
+	if got.Name != ss.Name {
+		t.Fatalf("Name = %q, want %q", got.Name, ss.Name)
+	}
+	field, ok := got.Fields["example.com"]
+	if !ok {
+		t.Fatal("round-tripped store is missing the \"example.com\" field")
+	}
+	plaintext, err := BoxDecrypt(ss.SymmetricKey, field.AuthPair)
+	if err != nil {
+		t.Fatalf("BoxDecrypt round-tripped field: %v", err)
+	}
+	if string(plaintext) != "hunter2" {
+		t.Fatalf("decrypted field = %q, want %q", plaintext, "hunter2")
+	}
+
+	if _, err := ks.GetStore("does-not-exist"); err != ErrStoreNotFound {
+		t.Fatalf("GetStore(missing) err = %v, want ErrStoreNotFound", err)
+	}
+}
+
+func TestPassphraseKeyStoreRoundTrip(t *testing.T) {
+	ks := NewPassphraseKeyStore(t.TempDir(), "correct horse battery staple")
+	ss := newRoundTripStore(t, "passphrase-store", []byte("correct horse battery staple"))
+
+	if err := ks.PutStore(ss); err != nil {
+		t.Fatalf("PutStore: %v", err)
+	}
+
+	got, err := ks.GetStore(ss.Name)
+	if err != nil {
+		t.Fatalf("GetStore: %v", err)
+	}
+	if got.Name != ss.Name {
+		t.Fatalf("Name = %q, want %q", got.Name, ss.Name)
+	}
+	if len(got.Fields) != len(ss.Fields) {
+		t.Fatalf("Fields count = %d, want %d", len(got.Fields), len(ss.Fields))
+	}
+}
+
+func TestMemoryKeyStoreRoundTrip(t *testing.T) {
+	ks := NewMemoryKeyStore()
+	ss := newRoundTripStore(t, "memory-store", nil)
+
+	if err := ks.PutStore(ss); err != nil {
+		t.Fatalf("PutStore: %v", err)
+	}
+
+	got, err := ks.GetStore(ss.Name)
+	if err != nil {
+		t.Fatalf("GetStore: %v", err)
+	}
+	if got != ss {
+		t.Fatal("MemoryKeyStore.GetStore returned a different *SecretStore than was put in")
+	}
+
+	if err := ks.DeleteStore(ss.Name); err != nil {
+		t.Fatalf("DeleteStore: %v", err)
+	}
+	if _, err := ks.GetStore(ss.Name); err != ErrStoreNotFound {
+		t.Fatalf("GetStore(deleted) err = %v, want ErrStoreNotFound", err)
+	}
+}
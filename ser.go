@@ -5,57 +5,255 @@ package ghostpass
 import (
 	"bytes"
 	"compress/zlib"
-	"encoding/base64"
+	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
+
+	"golang.org/x/crypto/scrypt"
+
+	"ghostpass/internal/memzero"
 )
 
+// SymmetricKey is the derived key material used to encrypt/decrypt a SecretStore's fields.
+// It carries its own Zero method so callers can wipe a store's key from memory once they're
+// done with it, mirroring kisom/cryptutils' util.Zero discipline.
+type SymmetricKey []byte
+
+// Zero overwrites k with zeroes in place so the key no longer lingers in memory after use.
+func (k SymmetricKey) Zero() {
+	memzero.Zero(k)
+}
+
+// plainsightSecret is the on-disk shape of a single field's encrypted secret. RealMAC
+// authenticates Real together with the header it was exported under, keyed by the real
+// passphrase's derived key, so a header swap or downgrade invalidates it -- see fieldMAC.
+// Shadow, ShadowService, and ShadowMAC are only populated for deniable fields (see
+// deniable.go): Shadow holds a second, independently-encrypted credential that surfaces instead
+// of Real when the store is opened with the field's decoy passphrase, ShadowService holds the
+// service name encrypted under that same decoy key (since the map key below only ever decrypts
+// under the real key), and ShadowMAC authenticates Shadow the same way RealMAC authenticates
+// Real, keyed by the decoy key instead.
+type plainsightSecret struct {
+	Real          []byte `json:"real"`
+	RealMAC       []byte `json:"real_mac"`
+	Shadow        []byte `json:"shadow,omitempty"`
+	ShadowService []byte `json:"shadow_service,omitempty"`
+	ShadowMAC     []byte `json:"shadow_mac,omitempty"`
+}
+
+// plainsightEnvelope is the on-disk shape of a plainsight store, compressed and carrier-wrapped
+// as a whole: a header describing how to rederive the symmetric key, and the indistinguishable
+// fields, each individually authenticated via its own RealMAC/ShadowMAC -- see plainsightSecret.
+type plainsightEnvelope struct {
+	Header storeHeader                  `json:"header"`
+	Fields map[string]*plainsightSecret `json:"fields"`
+}
+
+// ScryptMode selects a tradeoff between KDF latency and brute-force resistance, mirroring
+// libsodium's interactive/sensitive presets.
+type ScryptMode int
+
+const (
+	// ScryptInteractive is tuned for frequent, latency-sensitive unlocks.
+	ScryptInteractive ScryptMode = iota
+	// ScryptSensitive trades latency for much stronger brute-force resistance, intended for
+	// long-lived, high-value stores.
+	ScryptSensitive
+)
+
+// ScryptParams holds the cost parameters fed to scrypt.Key, alongside the mode they were
+// derived from, so a store stays decryptable from its own header even after the defaults for
+// that mode change.
+type ScryptParams struct {
+	Mode ScryptMode `json:"mode"`
+	N    int        `json:"n"`
+	R    int        `json:"r"`
+	P    int        `json:"p"`
+}
+
+// scryptSaltLen is the size, in bytes, of the random salt generated for each store.
+const scryptSaltLen = 16
+
+// scryptKeyLen is the size, in bytes, of the symmetric key scrypt derives.
+const scryptKeyLen = 32
+
+// scryptParamsForMode returns the canonical cost parameters for a given mode.
+func scryptParamsForMode(mode ScryptMode) ScryptParams {
+	switch mode {
+	case ScryptSensitive:
+		return ScryptParams{Mode: ScryptSensitive, N: 1 << 20, R: 8, P: 1}
+	default:
+		return ScryptParams{Mode: ScryptInteractive, N: 1 << 15, R: 8, P: 1}
+	}
+}
+
+// deriveKey runs scrypt over the raw passphrase with the given salt and params, producing the
+// symmetric key used to encrypt/decrypt a store.
+func deriveKey(passphrase, salt []byte, params ScryptParams) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, params.N, params.R, params.P, scryptKeyLen)
+}
+
+// ensureKDF returns the salt and params this store's symmetric key should be (or already was)
+// derived with, generating a fresh random salt under ss.KDFParams' mode the first time a brand
+// new store is marshaled.
+func (ss *SecretStore) ensureKDF() ([]byte, ScryptParams, error) {
+	if ss.KDFParams.N == 0 {
+		ss.KDFParams = scryptParamsForMode(ss.KDFParams.Mode)
+	}
+	if len(ss.KDFSalt) != scryptSaltLen {
+		salt := make([]byte, scryptSaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, ScryptParams{}, err
+		}
+		ss.KDFSalt = salt
+	}
+	return ss.KDFSalt, ss.KDFParams, nil
+}
+
+// stationaryEnvelope is the on-disk shape of a stationary store: a header describing how to
+// rederive the symmetric key, the fields themselves, and a MAC over both that's verified
+// before anything else is trusted.
+type stationaryEnvelope struct {
+	Header storeHeader       `json:"header"`
+	Fields map[string]*Field `json:"fields"`
+	MAC    []byte            `json:"mac"`
+}
+
+// stationaryPlainEnvelope is the on-disk shape PlainKeyStore uses: a store written out exactly
+// as it stands in memory, with no key derivation and no integrity MAC at all. It exists
+// because PlainKeyStore never has a passphrase to rederive a symmetric key from, so it can't
+// take part in the scrypt/MAC envelope StationaryMarshal/StationaryUnmarshal now require.
+type stationaryPlainEnvelope struct {
+	Version    int               `json:"version"`
+	StoreState string            `json:"state"`
+	Name       string            `json:"name"`
+	Fields     map[string]*Field `json:"fields"`
+}
+
+// StationaryMarshalPlain serializes ss with no encryption, key derivation, or integrity MAC:
+// fields are written out verbatim. It backs PlainKeyStore, which by design never has a
+// passphrase to derive a key from; anything that needs real confidentiality or tamper-evidence
+// should go through StationaryMarshal/StationaryUnmarshal instead.
+func (ss *SecretStore) StationaryMarshalPlain() ([]byte, error) {
+	return json.Marshal(&stationaryPlainEnvelope{
+		Version:    ss.Version,
+		StoreState: ss.StoreState,
+		Name:       ss.Name,
+		Fields:     ss.Fields,
+	})
+}
+
+// StationaryUnmarshalPlain is the inverse of StationaryMarshalPlain: it reads a store back
+// verbatim, performing no decryption and no MAC check.
+func StationaryUnmarshalPlain(serialized []byte) (*SecretStore, error) {
+	var env stationaryPlainEnvelope
+	if err := json.Unmarshal(serialized, &env); err != nil {
+		return nil, err
+	}
+
+	return &SecretStore{
+		Version:    env.Version,
+		StoreState: env.StoreState,
+		Name:       env.Name,
+		Fields:     env.Fields,
+	}, nil
+}
+
+// StationaryMarshal serializes a `SecretStore` into its stationary, on-disk JSON form. Fields
+// keep their plaintext service names and already-encrypted auth pairs as-is, since stationary
+// mode assumes the store itself is access-controlled rather than indistinguishable. This is the
+// serialization layer that `KeyStore` implementations compose on top of.
+func (ss *SecretStore) StationaryMarshal() ([]byte, error) {
+	salt, params, err := ss.ensureKDF()
+	if err != nil {
+		return nil, err
+	}
+
+	header := storeHeader{
+		Version:    ss.Version,
+		StoreState: ss.StoreState,
+		Name:       ss.Name,
+		Salt:       salt,
+		KDFParams:  params,
+	}
+
+	mac, err := envelopeMAC(ss.SymmetricKey, header, ss.Fields)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&stationaryEnvelope{
+		Header: header,
+		Fields: ss.Fields,
+		MAC:    mac,
+	})
+}
+
 // Helper function that converts a stationary persistent store back into a `SecretStore` for interaction.
 // Putting the store in stationary mode preserves more state than plainsight mode, so not much decryption is needed.
-func StationaryUnmarshal(checksum [32]byte, serialized []byte) (*SecretStore, error) {
+// Unlike prior versions, the caller hands in the raw passphrase rather than a precomputed checksum: the symmetric
+// key is rederived from the salt and KDF params embedded in the serialized store itself.
+func StationaryUnmarshal(passphrase []byte, serialized []byte) (*SecretStore, error) {
 
 	// turn the serialized JSON back into a partially initialized state for a SecretStore
-	var ss struct {
-		Version    int               `json:"version"`
-		StoreState string            `json:"state"`
-		Name       string            `json:"name"`
-		Fields     map[string]*Field `json:"fields"`
+	var env stationaryEnvelope
+	if err := json.Unmarshal(serialized, &env); err != nil {
+		return nil, err
 	}
-	err := json.Unmarshal(serialized, &ss)
+
+	// rederive the symmetric key from the raw passphrase using the embedded salt/params
+	key, err := deriveKey(passphrase, env.Header.Salt, env.Header.KDFParams)
 	if err != nil {
 		return nil, err
 	}
 
+	// reject before touching a single field if the header or fields were tampered with
+	if err := verifyEnvelopeMAC(key, env.Header, env.Fields, env.MAC); err != nil {
+		return nil, err
+	}
+
 	// no need to decrypt service, since this it's not encrypted. We are also
 	// not making a copy since we are just mutating the state of the fields
-	for _, field := range ss.Fields {
+	for _, field := range env.Fields {
 		// rederive attributes of partial field
-		if err := field.RederiveAuthPair(checksum[:]); err != nil {
+		if err := field.RederiveAuthPair(key); err != nil {
 			return nil, err
 		}
 	}
 
-	// return the SecretStore as if nothing changed
+	// return the SecretStore as if nothing changed. As in PlainsightUnmarshal, key isn't
+	// zeroed here since it becomes SymmetricKey and the store still needs it.
 	return &SecretStore{
-		Version:      ss.Version,
-		StoreState:   ss.StoreState,
-		Name:         ss.Name,
-		SymmetricKey: checksum[:],
-		Fields:       ss.Fields,
+		Version:      env.Header.Version,
+		StoreState:   env.Header.StoreState,
+		Name:         env.Header.Name,
+		SymmetricKey: SymmetricKey(key),
+		KDFSalt:      env.Header.Salt,
+		KDFParams:    env.Header.KDFParams,
+		Fields:       env.Fields,
 	}, nil
 }
 
 // Helper routine that prepares a secret store from an exported plainsight
 // distribution. Since the state stored on disk does not contain any remnants of the auth
-// credentials per field, this unmarshaller rederives that using the given symmetric key.
-func PlainsightUnmarshal(checksum [32]byte, encoded []byte) (*SecretStore, error) {
+// credentials per field, this unmarshaller rederives that using the given passphrase, after
+// first rederiving the symmetric key from the salt/params embedded in the encoded blob.
+func PlainsightUnmarshal(passphrase []byte, encoded []byte) (*SecretStore, error) {
 
-	// decode from base64
-	compressed, err := base64.StdEncoding.DecodeString(string(encoded))
+	// sniff which carrier produced this blob from its magic prefix, falling back to plain,
+	// unprefixed base64 so stores written before carriers existed keep working
+	var compressed []byte
+	var err error
+	if carrier, ok := detectCarrier(encoded); ok {
+		compressed, err = carrier.Decode(encoded)
+	} else {
+		compressed, err = legacyBase64Decode(encoded)
+	}
 	if err != nil {
 		return nil, err
 	}
+	defer memzero.Zero(compressed)
 
 	// decompress the compressed input before deserializing
 	reader, err := zlib.NewReader(bytes.NewReader(compressed))
@@ -68,22 +266,29 @@ func PlainsightUnmarshal(checksum [32]byte, encoded []byte) (*SecretStore, error
 	if err != nil {
 		return nil, err
 	}
+	defer memzero.Zero(serialized)
 
 	// turn the serialized JSON back into a partially initialized state for a SecretStore
-	var ss struct {
-		Version    int               `json:"version"`
-		StoreState string            `json:"state"`
-		Name       string            `json:"name"`
-		Fields     map[string][]byte `json:"fields"`
+	var env plainsightEnvelope
+	if err := json.Unmarshal(serialized, &env); err != nil {
+		return nil, err
 	}
-	if err := json.Unmarshal(serialized, &ss); err != nil {
+
+	// rederive the symmetric key from the raw passphrase using the embedded salt/params
+	checksum, err := deriveKey(passphrase, env.Header.Salt, env.Header.KDFParams)
+	if err != nil {
 		return nil, err
 	}
 
+	// there's no single whole-envelope MAC to check up front: each field below authenticates
+	// itself (and the header bound into it) against whichever key -- real or decoy -- the
+	// supplied passphrase derives to, via RealMAC/ShadowMAC.
+
 	// create new semi-unencrypted mapping
 	fields := make(map[string]*Field)
+	total := len(env.Fields)
 
-	for servicekey, secret := range ss.Fields {
+	for servicekey, secret := range env.Fields {
 
 		// decode hex for key
 		dec, err := hex.DecodeString(servicekey)
@@ -91,42 +296,110 @@ func PlainsightUnmarshal(checksum [32]byte, encoded []byte) (*SecretStore, error
 			return nil, err
 		}
 
-		// decrypt service key if store file was plainsight exported
-		service, err := BoxDecrypt(checksum[:], []byte(dec))
+		// an entry that doesn't open under checksum at all isn't an error on its own: it's the
+		// expected outcome whenever checksum comes from a decoy passphrase, which only opens the
+		// deniable fields registered with it. The real passphrase opens every entry's Real side.
+		service, field, err := openPlainsightSecret(checksum, env.Header, dec, secret)
 		if err != nil {
 			return nil, err
 		}
-
-		// reinitialize field from compressed secret
-		field, err := ReconstructField(checksum[:], secret)
-		if err != nil {
-			return nil, err
+		if field == nil {
+			continue
 		}
 
 		// decomprethe string representation for secrets back into a field
 		fields[string(service)] = field
-		delete(ss.Fields, servicekey)
+		delete(env.Fields, servicekey)
+
+		// the decrypted service name has already been copied into the fields map key above,
+		// so the plaintext bytes backing it can be scrubbed
+		memzero.Zero(service)
 	}
 
-	// return the SecretStore as if nothing changed
+	// a passphrase that opens nothing at all out of a non-empty store is wrong, not a decoy --
+	// every legitimate passphrase (real or decoy) opens at least the one field it belongs to.
+	if len(fields) == 0 && total > 0 {
+		return nil, ErrStoreTampered
+	}
+
+	// return the SecretStore as if nothing changed. checksum deliberately isn't zeroed here:
+	// it becomes SymmetricKey below and the store still needs it to re-marshal or decrypt
+	// further fields later. Callers should invoke SymmetricKey.Zero() once they're done with
+	// the store.
 	return &SecretStore{
-		Version:      ss.Version,
+		Version:      env.Header.Version,
 		StoreState:   StoreStationary,
-		Name:         ss.Name,
-		SymmetricKey: checksum[:],
+		Name:         env.Header.Name,
+		SymmetricKey: SymmetricKey(checksum),
+		KDFSalt:      env.Header.Salt,
+		KDFParams:    env.Header.KDFParams,
 		Fields:       fields,
 	}, nil
 }
 
+// openPlainsightSecret attempts to recover a single plainsight entry's plaintext service name
+// and Field under checksum, trying the real credential first and the deniable decoy second. A
+// nil field with a nil error means checksum simply doesn't unlock this entry -- expected
+// whenever it belongs to a different field, or to a decoy passphrase the caller doesn't hold.
+func openPlainsightSecret(checksum []byte, header storeHeader, mapKeyCiphertext []byte, secret *plainsightSecret) ([]byte, *Field, error) {
+	if service, err := BoxDecrypt(checksum, mapKeyCiphertext); err == nil {
+		ok, err := verifyFieldMAC(checksum, header, string(service), secret.Real, secret.RealMAC)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			field, err := ReconstructField(checksum, secret.Real)
+			if err != nil {
+				return nil, nil, err
+			}
+			return service, field, nil
+		}
+	}
+
+	if len(secret.ShadowService) == 0 {
+		return nil, nil, nil
+	}
+
+	service, err := BoxDecrypt(checksum, secret.ShadowService)
+	if err != nil {
+		return nil, nil, nil
+	}
+	ok, err := verifyFieldMAC(checksum, header, string(service), secret.Shadow, secret.ShadowMAC)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, nil
+	}
+	field, err := ReconstructField(checksum, secret.Shadow)
+	if err != nil {
+		return nil, nil, err
+	}
+	return service, field, nil
+}
+
 // Helper routine that helps prepare a secret store to be plainsight distributable, by
-// incorporating indistinguishability to all entries, stripping the symmetric key checksum,
-// compressing the final store, and applying one-time pads for deniability (TODO).
-func (ss *SecretStore) PlainsightMarshal() ([]byte, error) {
+// incorporating indistinguishability to all entries, stripping the symmetric key checksum, and
+// compressing the final store. Deniable fields (see deniable.go) carry their decoy ciphertext,
+// decoy-encrypted service name, and decoy MAC through unchanged, since those are all fixed at
+// AddDeniablePair time. enc controls what the final compressed blob is wrapped in; passing nil
+// falls back to Base64Carrier, the same base64 encoding plainsight stores used before carriers
+// existed, behind Base64Carrier's magic prefix.
+func (ss *SecretStore) PlainsightMarshal(enc CarrierEncoder) ([]byte, error) {
+	if enc == nil {
+		enc = Base64Carrier{}
+	}
+
+	salt, params, err := ss.ensureKDF()
+	if err != nil {
+		return nil, err
+	}
+	header := ss.plainsightHeader(salt, params)
 
 	// stores a final compressed mapping for the secret store's fields, where
 	// keys are encrypted for indistinguishability and a compressed form of the credential pair
 	// is also created to map against for serialization.
-	encfields := make(map[string][]byte)
+	encfields := make(map[string]*plainsightSecret)
 
 	// encrypt all the service keys for indistinguishability
 	for service, field := range ss.Fields {
@@ -137,30 +410,36 @@ func (ss *SecretStore) PlainsightMarshal() ([]byte, error) {
 			return nil, err
 		}
 
-		// TODO: if deniable secrets are found, apply one-time pad to mutate secret
-		secret := field.AuthPair
+		secret := &plainsightSecret{Real: field.AuthPair}
+		realMAC, err := fieldMAC(ss.SymmetricKey, header, service, secret.Real)
+		if err != nil {
+			return nil, err
+		}
+		secret.RealMAC = realMAC
+
+		// if this field was registered via AddDeniablePair, publish its decoy ciphertext and
+		// decoy-encrypted service name alongside the real ones, so a decoy passphrase can find
+		// and authenticate its own entry without the real key's involvement
+		if field.Deniable {
+			secret.Shadow = field.ShadowAuthPair
+			secret.ShadowService = field.ShadowService
+			secret.ShadowMAC = field.ShadowMAC
+		}
 
 		// store the new encrypted entry
-		enc := hex.EncodeToString(encservice)
-		encfields[enc] = secret
+		encKey := hex.EncodeToString(encservice)
+		encfields[encKey] = secret
 	}
 
 	// serialize into a byte array for compression
-	data, err := json.Marshal(&struct {
-		Version    int               `json:"version"`
-		StoreState string            `json:"state"`
-		Name       string            `json:"name"`
-		Fields     map[string][]byte `json:"fields"`
-	}{
-		Version:    Version,
-		StoreState: StorePlainsight,
-		Name:       ss.Name,
-		Fields:     encfields,
+	data, err := json.Marshal(&plainsightEnvelope{
+		Header: header,
+		Fields: encfields,
 	})
-
 	if err != nil {
 		return nil, err
 	}
+	defer memzero.Zero(data)
 
 	// apply zlib compression
 	var buf bytes.Buffer
@@ -171,8 +450,8 @@ func (ss *SecretStore) PlainsightMarshal() ([]byte, error) {
 	if err := gz.Close(); err != nil {
 		return nil, err
 	}
+	defer memzero.Zero(buf.Bytes())
 
-	// finalize encoded stream for return
-	res := base64.StdEncoding.EncodeToString(buf.Bytes())
-	return []byte(res), nil
+	// wrap the compressed, encrypted store in the chosen carrier for the final export
+	return enc.Encode(buf.Bytes())
 }
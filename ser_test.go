@@ -0,0 +1,202 @@
+package ghostpass
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+func newPlainsightStore(t *testing.T, passphrase []byte) (*SecretStore, *Field) {
+	t.Helper()
+
+	ss := &SecretStore{Name: "plainsight-store", Fields: make(map[string]*Field)}
+	if _, _, err := ss.ensureKDF(); err != nil {
+		t.Fatalf("ensureKDF: %v", err)
+	}
+	key, err := deriveKey(passphrase, ss.KDFSalt, ss.KDFParams)
+	if err != nil {
+		t.Fatalf("deriveKey: %v", err)
+	}
+	ss.SymmetricKey = key
+
+	authPair, err := BoxEncrypt(ss.SymmetricKey, []byte("s3cr3t"))
+	if err != nil {
+		t.Fatalf("BoxEncrypt: %v", err)
+	}
+	field := &Field{AuthPair: authPair}
+	ss.Fields["example.com"] = field
+
+	return ss, field
+}
+
+func TestPlainsightRoundTripRealPassphrase(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	ss, _ := newPlainsightStore(t, passphrase)
+
+	encoded, err := ss.PlainsightMarshal(nil)
+	if err != nil {
+		t.Fatalf("PlainsightMarshal: %v", err)
+	}
+
+	got, err := PlainsightUnmarshal(passphrase, encoded)
+	if err != nil {
+		t.Fatalf("PlainsightUnmarshal: %v", err)
+	}
+	if _, ok := got.Fields["example.com"]; !ok {
+		t.Fatal("round-tripped plainsight store is missing the \"example.com\" field")
+	}
+}
+
+func TestPlainsightUnmarshalRejectsTamperedEnvelope(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	ss, _ := newPlainsightStore(t, passphrase)
+
+	encoded, err := ss.PlainsightMarshal(nil)
+	if err != nil {
+		t.Fatalf("PlainsightMarshal: %v", err)
+	}
+
+	tampered := tamperPlainsightField(t, encoded)
+
+	if _, err := PlainsightUnmarshal(passphrase, tampered); err != ErrStoreTampered {
+		t.Fatalf("PlainsightUnmarshal(tampered) err = %v, want ErrStoreTampered", err)
+	}
+}
+
+// TestPlainsightUnmarshalRejectsForgedHeader confirms a field's MAC can't be satisfied by an
+// attacker who only has the blob itself: forging the header (here, downgrading StoreState back
+// to stationary) without knowing the real passphrase must be rejected, even though the salt and
+// every other public value in the header are right there in the blob to read.
+func TestPlainsightUnmarshalRejectsForgedHeader(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	ss, _ := newPlainsightStore(t, passphrase)
+
+	encoded, err := ss.PlainsightMarshal(nil)
+	if err != nil {
+		t.Fatalf("PlainsightMarshal: %v", err)
+	}
+
+	env := decodePlainsightEnvelope(t, encoded)
+	env.Header.StoreState = StoreStationary
+
+	tamperedJSON, err := json.Marshal(&env)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	tampered := repackPlainsightEnvelope(t, tamperedJSON)
+
+	if _, err := PlainsightUnmarshal(passphrase, tampered); err != ErrStoreTampered {
+		t.Fatalf("PlainsightUnmarshal(forged header) err = %v, want ErrStoreTampered", err)
+	}
+}
+
+// TestPlainsightUnmarshalDecoyPassphraseRevealsShadow exercises AddDeniablePair's decoy path
+// end to end: PlainsightUnmarshal called with the decoy passphrase, not the real one, must
+// reveal the decoy secret rather than erroring or recovering the real one.
+func TestPlainsightUnmarshalDecoyPassphraseRevealsShadow(t *testing.T) {
+	realPassphrase := []byte("real passphrase")
+	decoyPassphrase := []byte("decoy passphrase")
+
+	ss := &SecretStore{Name: "deniable-store", Fields: make(map[string]*Field)}
+	if _, _, err := ss.ensureKDF(); err != nil {
+		t.Fatalf("ensureKDF: %v", err)
+	}
+	key, err := deriveKey(realPassphrase, ss.KDFSalt, ss.KDFParams)
+	if err != nil {
+		t.Fatalf("deriveKey: %v", err)
+	}
+	ss.SymmetricKey = key
+
+	if err := ss.AddDeniablePair("example.com", "real-secretA", "decoy-secret", decoyPassphrase); err != nil {
+		t.Fatalf("AddDeniablePair: %v", err)
+	}
+
+	encoded, err := ss.PlainsightMarshal(nil)
+	if err != nil {
+		t.Fatalf("PlainsightMarshal: %v", err)
+	}
+
+	got, err := PlainsightUnmarshal(decoyPassphrase, encoded)
+	if err != nil {
+		t.Fatalf("PlainsightUnmarshal(decoy): %v", err)
+	}
+	field, ok := got.Fields["example.com"]
+	if !ok {
+		t.Fatal("decoy-passphrase unmarshal is missing the \"example.com\" field")
+	}
+	plaintext, err := BoxDecrypt(got.SymmetricKey, field.AuthPair)
+	if err != nil {
+		t.Fatalf("BoxDecrypt revealed field: %v", err)
+	}
+	if string(plaintext) != "decoy-secret" {
+		t.Fatalf("revealed secret = %q, want %q", plaintext, "decoy-secret")
+	}
+}
+
+// decodePlainsightEnvelope unwraps a Base64Carrier-encoded plainsight blob down to its JSON
+// envelope, for tests that need to inspect or mutate it directly.
+func decodePlainsightEnvelope(t *testing.T, encoded []byte) plainsightEnvelope {
+	t.Helper()
+
+	compressed, err := (Base64Carrier{}).Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	reader, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("zlib.NewReader: %v", err)
+	}
+	serialized, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+
+	var env plainsightEnvelope
+	if err := json.Unmarshal(serialized, &env); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	return env
+}
+
+// tamperPlainsightField unwraps a Base64Carrier-encoded plainsight blob, flips a byte in one
+// field's ciphertext, and re-wraps it -- simulating a swapped-in or corrupted field without
+// touching its MAC.
+func tamperPlainsightField(t *testing.T, encoded []byte) []byte {
+	t.Helper()
+
+	env := decodePlainsightEnvelope(t, encoded)
+	for _, secret := range env.Fields {
+		secret.Real[0] ^= 0xff
+		break
+	}
+
+	tamperedJSON, err := json.Marshal(&env)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	return repackPlainsightEnvelope(t, tamperedJSON)
+}
+
+// repackPlainsightEnvelope compresses and Base64Carrier-wraps a plainsight envelope's raw JSON,
+// the inverse of decodePlainsightEnvelope, for tests that need to feed a hand-mutated envelope
+// back through PlainsightUnmarshal.
+func repackPlainsightEnvelope(t *testing.T, envelopeJSON []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := zlib.NewWriter(&buf)
+	if _, err := gz.Write(envelopeJSON); err != nil {
+		t.Fatalf("zlib.Write: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("zlib.Close: %v", err)
+	}
+
+	out, err := (Base64Carrier{}).Encode(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	return out
+}